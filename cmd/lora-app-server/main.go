@@ -6,31 +6,37 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/coreos/go-systemd/daemon"
 	assetfs "github.com/elazarl/go-bindata-assetfs"
 	"github.com/gorilla/mux"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/grpc-ecosystem/grpc-gateway/runtime"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/soheilhy/cmux"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/acme/autocert"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/grpclog"
+	"google.golang.org/grpc/test/bufconn"
 
 	pb "github.com/brocaar/lora-app-server/api"
 	"github.com/brocaar/lora-app-server/internal/api"
 	"github.com/brocaar/lora-app-server/internal/api/auth"
 	"github.com/brocaar/lora-app-server/internal/common"
+	"github.com/brocaar/lora-app-server/internal/interceptors"
 	"github.com/brocaar/lora-app-server/internal/static"
 	"github.com/brocaar/lora-app-server/internal/storage"
+	ltls "github.com/brocaar/lora-app-server/internal/tls"
 	"github.com/brocaar/loraserver/api/as"
 )
 
@@ -50,10 +56,152 @@ func run(c *cli.Context) error {
 		"docs":    "https://docs.loraserver.io/",
 	}).Info("starting LoRa App Server")
 
+	// the file-based cert flags that actually back the https listener
+	// depend on the active serving mode: --two-port-mode reads
+	// http-tls-cert/http-tls-key, while the default single-port (cmux)
+	// mode reads tls-cert/tls-key for that same listener.
+	if c.Bool("acme") {
+		if c.Bool("two-port-mode") {
+			if c.IsSet("http-tls-cert") || c.IsSet("http-tls-key") {
+				log.Fatal("acme and --http-tls-cert/--http-tls-key are mutually exclusive")
+			}
+		} else {
+			if c.IsSet("tls-cert") || c.IsSet("tls-key") {
+				log.Fatal("acme and --tls-cert/--tls-key are mutually exclusive")
+			}
+			// in the default single-port mode the application-server api
+			// and the client api share one TLS listener, and the
+			// application-server api requires its callers to present a
+			// verified mutual-TLS client certificate. autocert.Manager's
+			// TLSConfig() never requests a client certificate, so that
+			// check would reject every application-server api call,
+			// permanently, as soon as acme took over the listener.
+			// two-port-mode keeps the application-server api on its own
+			// listener, so acme there only ever affects the client api.
+			log.Fatal("acme is only supported together with --two-port-mode, since the application-server api on the combined listener requires a mutual-TLS client certificate that acme cannot provide")
+		}
+	}
+
 	// get context
 	lsCtx := mustGetContext(c)
 
-	// start the application-server api
+	serve := serveCmux
+	if c.Bool("two-port-mode") {
+		serve = serveTwoPort
+	}
+	shutdown := serve(ctx, lsCtx, c)
+
+	metricsServer := mustGetMetricsServer(c)
+	go func() {
+		log.WithField("bind", c.String("metrics-bind")).Info("starting metrics server")
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("metrics server error: %s", err)
+		}
+	}()
+
+	sdNotify(daemon.SdNotifyReady)
+	go sdWatchdog(ctx)
+
+	sigChan := make(chan os.Signal)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	log.WithField("signal", <-sigChan).Info("signal received, stopping lora-app-server")
+	sdNotify(daemon.SdNotifyStopping)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), c.Duration("shutdown-timeout"))
+	defer shutdownCancel()
+	shutdown(shutdownCtx)
+
+	log.Info("draining metrics server")
+	if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+		log.Warningf("metrics server shutdown error: %s", err)
+	}
+
+	log.Info("closing postgresql connection")
+	if err := lsCtx.DB.Close(); err != nil {
+		log.Warningf("close database error: %s", err)
+	}
+
+	cancel()
+
+	return nil
+}
+
+// serveCmux is the default serving mode: a single configurable listener
+// (--bind) multiplexes HTTP/2 gRPC (application-server api and client api)
+// and HTTP/1.1 (REST gateway, swagger UI and web assets) using cmux, with
+// TLS terminated once for the combined listener.
+func serveCmux(ctx context.Context, lsCtx common.Context, c *cli.Context) func(ctx context.Context) {
+	log.WithField("bind", c.String("bind")).Info("starting combined application-server, client api and web interface")
+
+	ln, err := net.Listen("tcp", c.String("bind"))
+	if err != nil {
+		log.Fatalf("start listener error: %s", err)
+	}
+
+	// run() already refuses to start with --acme set unless --two-port-mode
+	// is also set, since the application-server api below requires a
+	// mutual-TLS client certificate that acme's TLSConfig() never requests.
+	tlsConfigurator := mustGetTLSConfigurator(c, c.String("tls-cert"), c.String("tls-key"), c.String("ca-cert"))
+	// client certs are optional at the listener level: the loraserver
+	// backend authenticates with a mutual-TLS client cert verified against
+	// ca-cert, while browsers / the web interface connect without
+	// presenting one; the application-server api interceptor below
+	// enforces that the loraserver backend did present one.
+	tlsLn := tls.NewListener(ln, tlsConfigurator.ServerTLSConfig(tls.VerifyClientCertIfGiven))
+
+	m := cmux.New(tlsLn)
+	grpcLn := m.Match(cmux.HTTP2())
+	httpLn := m.Match(cmux.HTTP1Fast())
+
+	// the application-server api (loraserver-facing) and the client api
+	// share this one grpc.Server, so the listener-level
+	// tls.VerifyClientCertIfGiven above can't enforce mutual TLS for the
+	// application-server api alone. Enforce that per-service via an
+	// interceptor instead; the client api's own authentication (JWT) is
+	// handled per-request inside registerClientAPI's handlers, same as the
+	// two-port serving mode.
+	asPrefix := "/" + asAPIServiceName() + "/"
+	opts := interceptorOptionsFromFlags(c)
+	opts.RequireClientCertFor = asPrefix
+	gs := grpc.NewServer(interceptors.ServerOptions(opts)...)
+	registerApplicationServerAPI(gs, lsCtx)
+	registerClientAPI(gs, ctx, lsCtx, c)
+	grpc_prometheus.Register(gs)
+	go gs.Serve(grpcLn)
+
+	bufLn := bufconn.Listen(1024 * 1024)
+	go gs.Serve(bufLn)
+
+	httpHandler := mustGetHTTPHandler(ctx, lsCtx, c, gs, bufLn)
+	httpServer := &http.Server{Handler: httpHandler}
+	go func() {
+		if err := httpServer.Serve(httpLn); err != nil && err != http.ErrServerClosed && err != cmux.ErrListenerClosed {
+			log.Fatalf("http server error: %s", err)
+		}
+	}()
+
+	go func() {
+		if err := m.Serve(); err != nil && err != cmux.ErrListenerClosed {
+			log.Fatalf("cmux serve error: %s", err)
+		}
+	}()
+
+	return func(shutdownCtx context.Context) {
+		log.Info("draining http server")
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Warningf("http server shutdown error: %s", err)
+		}
+
+		log.Info("draining combined grpc server")
+		gracefulStop(shutdownCtx, gs)
+	}
+}
+
+// serveTwoPort is the pre-cmux compatibility mode: the application-server
+// api keeps its own listener (--bind) and the client api / web interface
+// share a second HTTPS listener (--http-bind), as lora-app-server served
+// before cmux-based single-port serving was introduced.
+func serveTwoPort(ctx context.Context, lsCtx common.Context, c *cli.Context) func(ctx context.Context) {
 	log.WithField("bind", c.String("bind")).Info("starting application-server api")
 	apiServer := mustGetAPIServer(lsCtx, c)
 	ln, err := net.Listen("tcp", c.String("bind"))
@@ -62,41 +210,104 @@ func run(c *cli.Context) error {
 	}
 	go apiServer.Serve(ln)
 
-	// setup the client api interface
-	clientAPIHandler := mustGetClientAPIServer(ctx, lsCtx, c)
+	clientAPIServer := mustGetClientAPIServer(ctx, lsCtx, c)
 
-	// setup the client http interface
-	clientHTTPHandler := mustGetHTTPHandler(ctx, lsCtx, c)
+	bufLn := bufconn.Listen(1024 * 1024)
+	go clientAPIServer.Serve(bufLn)
+
+	var httpTLSConfig *tls.Config
+	if c.Bool("acme") {
+		httpTLSConfig = mustGetACMEManager(c).TLSConfig()
+	} else {
+		httpTLSConfigurator := mustGetTLSConfigurator(c, c.String("http-tls-cert"), c.String("http-tls-key"), c.String("http-tls-cert"))
+		httpTLSConfig = httpTLSConfigurator.ServerTLSConfig(tls.NoClientCert)
+	}
+
+	clientHTTPHandler := mustGetHTTPHandler(ctx, lsCtx, c, clientAPIServer, bufLn)
 
 	// switch between gRPC and "plain" http handler
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.ProtoMajor == 2 && strings.Contains(r.Header.Get("Content-Type"), "application/grpc") {
-			clientAPIHandler.ServeHTTP(w, r)
+			clientAPIServer.ServeHTTP(w, r)
 		} else {
 			clientHTTPHandler.ServeHTTP(w, r)
 		}
 	})
+	httpServer := &http.Server{
+		Addr:      c.String("http-bind"),
+		Handler:   handler,
+		TLSConfig: httpTLSConfig,
+	}
 	go func() {
 		log.WithField("bind", c.String("http-bind")).Info("starting client api server")
-		log.Fatal(http.ListenAndServeTLS(c.String("http-bind"), c.String("http-tls-cert"), c.String("http-tls-key"), handler))
+		// cert/key are served from httpServer.TLSConfig.GetConfigForClient,
+		// or from autocert's GetCertificate when --acme is set
+		err := httpServer.ListenAndServeTLS("", "")
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("client api server error: %s", err)
+		}
 	}()
 
-	sigChan := make(chan os.Signal)
-	exitChan := make(chan struct{})
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	log.WithField("signal", <-sigChan).Info("signal received")
+	return func(shutdownCtx context.Context) {
+		log.Info("draining client http api")
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			log.Warningf("client http api shutdown error: %s", err)
+		}
+
+		log.Info("draining client api")
+		gracefulStop(shutdownCtx, clientAPIServer)
+
+		log.Info("draining application-server api")
+		gracefulStop(shutdownCtx, apiServer)
+	}
+}
+
+// sdNotify sends the given state to systemd, ignoring the "not running under
+// systemd" case so that it is a no-op outside of systemd-managed deployments.
+func sdNotify(state string) {
+	if _, err := daemon.SdNotify(false, state); err != nil {
+		log.Warningf("systemd notify error: %s", err)
+	}
+}
+
+// sdWatchdog pings the systemd watchdog at half the configured interval for
+// as long as ctx is alive, and is a no-op when WATCHDOG_USEC is unset.
+func sdWatchdog(ctx context.Context) {
+	interval, err := daemon.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sdNotify(daemon.SdNotifyWatchdog)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// gracefulStop calls gs.GracefulStop(), but falls back to an immediate
+// gs.Stop() if ctx expires first, so --shutdown-timeout bounds grpc
+// shutdown instead of GracefulStop blocking forever on a stuck RPC.
+func gracefulStop(ctx context.Context, gs *grpc.Server) {
+	stopped := make(chan struct{})
 	go func() {
-		log.Warning("stopping lora-app-server")
-		// todo: handle graceful shutdown?
-		exitChan <- struct{}{}
+		gs.GracefulStop()
+		close(stopped)
 	}()
+
 	select {
-	case <-exitChan:
-	case s := <-sigChan:
-		log.WithField("signal", s).Info("signal received, stopping immediately")
+	case <-stopped:
+	case <-ctx.Done():
+		log.Warning("grpc shutdown timeout exceeded, closing in-flight connections")
+		gs.Stop()
+		<-stopped
 	}
-
-	return nil
 }
 
 func mustGetContext(c *cli.Context) common.Context {
@@ -111,7 +322,13 @@ func mustGetContext(c *cli.Context) common.Context {
 	}
 }
 
-func mustGetClientAPIServer(ctx context.Context, lsCtx common.Context, c *cli.Context) *grpc.Server {
+// registerClientAPI registers the client-facing (web interface / REST
+// gateway) gRPC services onto gs, with validator responsible for both
+// authenticating the caller's JWT and authorizing the specific request
+// (e.g. organization / application access), since the latter depends on
+// fields of each request that a generic interceptor doesn't have
+// visibility into.
+func registerClientAPI(gs *grpc.Server, ctx context.Context, lsCtx common.Context, c *cli.Context) {
 	var validator auth.Validator
 	if c.String("jwt-secret") != "" {
 		validator = auth.NewJWTValidator("HS256", c.String("jwt-secret"))
@@ -120,36 +337,144 @@ func mustGetClientAPIServer(ctx context.Context, lsCtx common.Context, c *cli.Co
 		validator = auth.NopValidator{}
 	}
 
-	gs := grpc.NewServer()
 	pb.RegisterChannelServer(gs, api.NewChannelAPI(lsCtx, validator))
 	pb.RegisterChannelListServer(gs, api.NewChannelListAPI(lsCtx, validator))
 	pb.RegisterDownlinkQueueServer(gs, api.NewDownlinkQueueAPI(lsCtx, validator))
 	pb.RegisterNodeServer(gs, api.NewNodeAPI(lsCtx, validator))
 	//pb.RegisterNodeSessionServer(gs, api.NewNodeSessionAPI(lsCtx, validator))
+}
+
+// registerApplicationServerAPI registers the loraserver-facing
+// application-server gRPC service onto gs.
+func registerApplicationServerAPI(gs *grpc.Server, ctx common.Context) {
+	asAPI := api.NewApplicationServerAPI(ctx)
+	as.RegisterApplicationServerServer(gs, asAPI)
+}
+
+// asAPIServiceName returns the gRPC service name that
+// as.RegisterApplicationServerServer registers, by registering it onto a
+// throwaway server and reading it back, so callers that need to match
+// against it (e.g. to require a client certificate for that service only
+// on a shared listener) don't hardcode and risk drifting from the
+// generated proto service name.
+func asAPIServiceName() string {
+	tmp := grpc.NewServer()
+	as.RegisterApplicationServerServer(tmp, nil)
+	for name := range tmp.GetServiceInfo() {
+		return name
+	}
+	return ""
+}
 
+func mustGetClientAPIServer(ctx context.Context, lsCtx common.Context, c *cli.Context) *grpc.Server {
+	gs := grpc.NewServer(interceptors.ServerOptions(interceptorOptionsFromFlags(c))...)
+	registerClientAPI(gs, ctx, lsCtx, c)
+	grpc_prometheus.Register(gs)
 	return gs
 }
 
 func mustGetAPIServer(ctx common.Context, c *cli.Context) *grpc.Server {
-	var options []grpc.ServerOption
+	options := interceptors.ServerOptions(interceptorOptionsFromFlags(c))
 	if c.String("tls-cert") != "" && c.String("tls-key") != "" {
+		tlsConfigurator := mustGetTLSConfigurator(c, c.String("tls-cert"), c.String("tls-key"), c.String("ca-cert"))
 		options = append(options, grpc.Creds(
-			mustGetTransportCredentials(c.String("tls-cert"), c.String("tls-key"), c.String("ca-cert"), true),
+			credentials.NewTLS(tlsConfigurator.ServerTLSConfig(tls.RequireAndVerifyClientCert)),
 		))
 	}
 
 	gs := grpc.NewServer(options...)
-	asAPI := api.NewApplicationServerAPI(ctx)
-	as.RegisterApplicationServerServer(gs, asAPI)
+	registerApplicationServerAPI(gs, ctx)
+	grpc_prometheus.Register(gs)
 	return gs
 }
 
-func mustGetHTTPHandler(ctx context.Context, lsCtx common.Context, c *cli.Context) http.Handler {
+// mustGetTLSConfigurator returns a ltls.Configurator for certFile / keyFile
+// / caFile. When --auto-tls is set and certFile / keyFile don't exist on
+// disk, a self-signed certificate is generated (and, unless
+// --auto-tls-persist=false, written back to certFile / keyFile) instead of
+// failing to start, so first-time users, tests and CI don't need to
+// provision certificates out of band.
+func mustGetTLSConfigurator(c *cli.Context, certFile, keyFile, caFile string) *ltls.Configurator {
+	var tlsConfigurator *ltls.Configurator
+	var err error
+
+	if c.Bool("auto-tls") {
+		hosts := append([]string{"localhost", "127.0.0.1", "::1"}, c.StringSlice("auto-tls-host")...)
+		tlsConfigurator, err = ltls.NewAutoConfigurator(certFile, keyFile, caFile, hosts, c.BoolT("auto-tls-persist"))
+	} else {
+		tlsConfigurator, err = ltls.NewConfigurator(certFile, keyFile, caFile)
+	}
+	if err != nil {
+		log.Fatalf("setup tls configurator error: %s", err)
+	}
+
+	return tlsConfigurator
+}
+
+// interceptorOptionsFromFlags builds interceptors.Options from the
+// --grpc-* toggle flags.
+func interceptorOptionsFromFlags(c *cli.Context) interceptors.Options {
+	return interceptors.Options{
+		Recovery:   c.Bool("grpc-recovery"),
+		Prometheus: c.Bool("grpc-prometheus"),
+		Logging:    c.Bool("grpc-logging"),
+		Tracing:    c.Bool("grpc-tracing"),
+	}
+}
+
+// mustGetMetricsServer returns the http.Server exposing Prometheus metrics
+// and liveness / readiness probes on --metrics-bind.
+func mustGetMetricsServer(c *cli.Context) *http.Server {
+	r := mux.NewRouter()
+	r.Handle("/metrics", promhttp.Handler())
+	r.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return &http.Server{
+		Addr:    c.String("metrics-bind"),
+		Handler: r,
+	}
+}
+
+// mustGetACMEManager builds an autocert.Manager from the --acme-* flags,
+// for issuing and transparently renewing a publicly trusted certificate
+// instead of operators provisioning one out of band. Mutually exclusive
+// with the file-based --(http-)tls-cert / --(http-)tls-key flags.
+func mustGetACMEManager(c *cli.Context) *autocert.Manager {
+	hostnames := c.StringSlice("acme-hostname")
+	if len(hostnames) == 0 {
+		log.Fatal("acme: at least one --acme-hostname is required")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hostnames...),
+		Cache:      autocert.DirCache(c.String("acme-cache-dir")),
+		Email:      c.String("acme-email"),
+	}
+
+	if c.String("acme-challenge") == "http-01" {
+		go func() {
+			log.Info("acme: starting http-01 challenge listener on :80")
+			if err := http.ListenAndServe(":80", m.HTTPHandler(nil)); err != nil {
+				log.Errorf("acme: http-01 challenge listener error: %s", err)
+			}
+		}()
+	}
+
+	return m
+}
+
+func mustGetHTTPHandler(ctx context.Context, lsCtx common.Context, c *cli.Context, clientAPIServer *grpc.Server, bufLn *bufconn.Listener) http.Handler {
 
 	r := mux.NewRouter()
 
 	// setup json api handler
-	jsonHandler := mustGetJSONGateway(ctx, lsCtx, c)
+	jsonHandler := mustGetJSONGateway(ctx, clientAPIServer, bufLn)
 	log.WithField("path", "/api").Info("registering rest api handler and documentation endpoint")
 	r.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
 		data, err := static.Asset("swagger/index.html")
@@ -173,28 +498,19 @@ func mustGetHTTPHandler(ctx context.Context, lsCtx common.Context, c *cli.Contex
 	return r
 }
 
-func mustGetJSONGateway(ctx context.Context, lsCtx common.Context, c *cli.Context) http.Handler {
-	// dial options for the grpc-gateway
-	b, err := ioutil.ReadFile(c.String("http-tls-cert"))
+// mustGetJSONGateway wires the grpc-gateway REST mux to the client api
+// server over an in-process bufconn.Listener, so the gateway never dials
+// out over the network (and therefore needs no loopback TLS trust).
+func mustGetJSONGateway(ctx context.Context, clientAPIServer *grpc.Server, bufLn *bufconn.Listener) http.Handler {
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return bufLn.Dial()
+		}),
+		grpc.WithInsecure(),
+	)
 	if err != nil {
-		log.Fatalf("read http-tls-cert cert error: %s", err)
+		log.Fatalf("dial in-process client api error: %s", err)
 	}
-	cp := x509.NewCertPool()
-	if !cp.AppendCertsFromPEM(b) {
-		log.Fatal("failed to append certificate")
-	}
-	grpcDialOpts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
-		// given the grpc-gateway is always connecting to localhost, does
-		// InsecureSkipVerify=true cause any security issues?
-		InsecureSkipVerify: true,
-		RootCAs:            cp,
-	}))}
-
-	bindParts := strings.SplitN(c.String("http-bind"), ":", 2)
-	if len(bindParts) != 2 {
-		log.Fatal("get port from bind failed")
-	}
-	apiEndpoint := fmt.Sprintf("localhost:%s", bindParts[1])
 
 	mux := runtime.NewServeMux(runtime.WithMarshalerOption(
 		runtime.MIMEWildcard,
@@ -204,55 +520,25 @@ func mustGetJSONGateway(ctx context.Context, lsCtx common.Context, c *cli.Contex
 		},
 	))
 
-	if err := pb.RegisterChannelHandlerFromEndpoint(ctx, mux, apiEndpoint, grpcDialOpts); err != nil {
+	if err := pb.RegisterChannelHandler(ctx, mux, conn); err != nil {
 		log.Fatalf("register channel handler error: %s", err)
 	}
-	if err := pb.RegisterChannelListHandlerFromEndpoint(ctx, mux, apiEndpoint, grpcDialOpts); err != nil {
+	if err := pb.RegisterChannelListHandler(ctx, mux, conn); err != nil {
 		log.Fatalf("register channel-list handler error: %s", err)
 	}
-	if err := pb.RegisterDownlinkQueueHandlerFromEndpoint(ctx, mux, apiEndpoint, grpcDialOpts); err != nil {
+	if err := pb.RegisterDownlinkQueueHandler(ctx, mux, conn); err != nil {
 		log.Fatalf("register downlink queue handler error: %s", err)
 	}
-	if err := pb.RegisterNodeHandlerFromEndpoint(ctx, mux, apiEndpoint, grpcDialOpts); err != nil {
+	if err := pb.RegisterNodeHandler(ctx, mux, conn); err != nil {
 		log.Fatalf("register node handler error: %s", err)
 	}
-	if err := pb.RegisterNodeSessionHandlerFromEndpoint(ctx, mux, apiEndpoint, grpcDialOpts); err != nil {
+	if err := pb.RegisterNodeSessionHandler(ctx, mux, conn); err != nil {
 		log.Fatalf("register node-session handler error: %s", err)
 	}
 
 	return mux
 }
 
-func mustGetTransportCredentials(tlsCert, tlsKey, caCert string, verifyClientCert bool) credentials.TransportCredentials {
-	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
-	if err != nil {
-		log.Fatal("loading keypair error: %s", err)
-	}
-
-	var caCertPool *x509.CertPool
-	var clientAuth tls.ClientAuthType
-
-	if caCert != "" {
-		rawCACert, err := ioutil.ReadFile(caCert)
-		if err != nil {
-			log.Fatal("load ca cert error: %s", err)
-		}
-
-		caCertPool = x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(rawCACert)
-	}
-
-	if verifyClientCert {
-		clientAuth = tls.RequireAndVerifyClientCert
-	}
-
-	return credentials.NewTLS(&tls.Config{
-		Certificates: []tls.Certificate{cert},
-		RootCAs:      caCertPool,
-		ClientAuth:   clientAuth,
-	})
-}
-
 func main() {
 	app := cli.NewApp()
 	app.Name = "lora-app-server"
@@ -292,13 +578,18 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:   "bind",
-			Usage:  "ip:port to bind the api server",
+			Usage:  "ip:port to bind the api server to. in the default single-port mode this serves the application-server api, the client api, the REST gateway and the web-interface; in --two-port-mode it serves the application-server api only",
 			Value:  "0.0.0.0:8001",
 			EnvVar: "BIND",
 		},
+		cli.BoolFlag{
+			Name:   "two-port-mode",
+			Usage:  "serve the application-server api (--bind) and the client api / web-interface (--http-bind) on two separate listeners, as lora-app-server did before single-port (cmux) serving",
+			EnvVar: "TWO_PORT_MODE",
+		},
 		cli.StringFlag{
 			Name:   "http-bind",
-			Usage:  "ip:port to bind the (user facing) http server to (web-interface and REST / gRPC api)",
+			Usage:  "ip:port to bind the (user facing) http server to (web-interface and REST / gRPC api), only used in --two-port-mode",
 			Value:  "0.0.0.0:8080",
 			EnvVar: "HTTP_BIND",
 		},
@@ -319,6 +610,80 @@ func main() {
 			Usage:  "JWT secret used for api authentication / authorization (disabled when left blank)",
 			EnvVar: "JWT_SECRET",
 		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Usage:  "duration to wait for in-flight requests to complete before terminating on SIGTERM",
+			Value:  15 * time.Second,
+			EnvVar: "SHUTDOWN_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "metrics-bind",
+			Usage:  "ip:port to bind the prometheus metrics and /healthz, /readyz endpoints to",
+			Value:  "0.0.0.0:8002",
+			EnvVar: "METRICS_BIND",
+		},
+		cli.BoolTFlag{
+			Name:   "grpc-recovery",
+			Usage:  "recover from panics in grpc handlers, returning codes.Internal instead of crashing",
+			EnvVar: "GRPC_RECOVERY",
+		},
+		cli.BoolTFlag{
+			Name:   "grpc-prometheus",
+			Usage:  "expose per-rpc prometheus metrics on --metrics-bind",
+			EnvVar: "GRPC_PROMETHEUS",
+		},
+		cli.BoolTFlag{
+			Name:   "grpc-logging",
+			Usage:  "log each grpc request",
+			EnvVar: "GRPC_LOGGING",
+		},
+		cli.BoolTFlag{
+			Name:   "grpc-tracing",
+			Usage:  "create an opentracing span for each grpc request",
+			EnvVar: "GRPC_TRACING",
+		},
+		cli.BoolFlag{
+			Name:   "acme",
+			Usage:  "use Let's Encrypt (ACME) to provision and renew the https certificate, instead of --http-tls-cert/--http-tls-key",
+			EnvVar: "ACME",
+		},
+		cli.StringSliceFlag{
+			Name:   "acme-hostname",
+			Usage:  "hostname to request an ACME certificate for (repeatable)",
+			EnvVar: "ACME_HOSTNAME",
+		},
+		cli.StringFlag{
+			Name:   "acme-email",
+			Usage:  "contact e-mail address registered with the ACME account",
+			EnvVar: "ACME_EMAIL",
+		},
+		cli.StringFlag{
+			Name:   "acme-cache-dir",
+			Usage:  "directory to cache ACME account keys and issued certificates in",
+			Value:  "certs/acme-cache",
+			EnvVar: "ACME_CACHE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "acme-challenge",
+			Usage:  "ACME challenge type to use: tls-alpn-01 or http-01 (requires port 80 to be reachable)",
+			Value:  "tls-alpn-01",
+			EnvVar: "ACME_CHALLENGE",
+		},
+		cli.BoolFlag{
+			Name:   "auto-tls",
+			Usage:  "generate a self-signed certificate for the application-server api and http listeners when --(http-)tls-cert/--(http-)tls-key don't exist on disk, instead of refusing to start (development / test / CI use only)",
+			EnvVar: "AUTO_TLS",
+		},
+		cli.StringSliceFlag{
+			Name:   "auto-tls-host",
+			Usage:  "additional hostname or ip to include in the generated --auto-tls certificate, besides localhost, 127.0.0.1 and ::1 (repeatable)",
+			EnvVar: "AUTO_TLS_HOST",
+		},
+		cli.BoolTFlag{
+			Name:   "auto-tls-persist",
+			Usage:  "write the certificate generated by --auto-tls back to the configured cert / key paths, so subsequent restarts reuse it instead of generating a new one",
+			EnvVar: "AUTO_TLS_PERSIST",
+		},
 	}
 	app.Run(os.Args)
-}
\ No newline at end of file
+}
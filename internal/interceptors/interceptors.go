@@ -0,0 +1,135 @@
+// Package interceptors provides the shared gRPC server interceptor chain
+// used by the application-server and client api servers: grpc_ctxtags
+// request tagging (no request id is generated), OpenTracing spans,
+// Prometheus metrics, structured request logging, panic recovery, and the
+// mutual-TLS check needed when more than one of those servers share a
+// grpc.Server.
+package interceptors
+
+import (
+	"context"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_logrus "github.com/grpc-ecosystem/go-grpc-middleware/logging/logrus"
+	grpc_recovery "github.com/grpc-ecosystem/go-grpc-middleware/recovery"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	grpc_opentracing "github.com/grpc-ecosystem/go-grpc-middleware/tracing/opentracing"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Options toggles which interceptors are installed in the chain built by
+// ServerOptions.
+type Options struct {
+	Recovery   bool
+	Prometheus bool
+	Logging    bool
+	Tracing    bool
+
+	// RequireClientCertFor, when set, rejects calls to methods under this
+	// gRPC service prefix (e.g. "/as.ApplicationServer/") unless the peer
+	// presented a TLS client certificate that chained to a verified root.
+	// This is needed when a single grpc.Server / listener serves services
+	// with different trust requirements, since tls.ClientAuthType applies
+	// to the whole listener and can't be set per service.
+	RequireClientCertFor string
+}
+
+// ServerOptions builds the unary and stream interceptor chain described by
+// opts. When Prometheus is enabled, the caller must still call
+// grpc_prometheus.Register(gs) after registering handlers, so that
+// per-method histograms are pre-initialized.
+func ServerOptions(opts Options) []grpc.ServerOption {
+	var unary []grpc.UnaryServerInterceptor
+	var stream []grpc.StreamServerInterceptor
+
+	if opts.RequireClientCertFor != "" {
+		unary = append(unary, requireClientCertUnaryInterceptor(opts.RequireClientCertFor))
+		stream = append(stream, requireClientCertStreamInterceptor(opts.RequireClientCertFor))
+	}
+
+	unary = append(unary, grpc_ctxtags.UnaryServerInterceptor())
+	stream = append(stream, grpc_ctxtags.StreamServerInterceptor())
+
+	if opts.Tracing {
+		unary = append(unary, grpc_opentracing.UnaryServerInterceptor())
+		stream = append(stream, grpc_opentracing.StreamServerInterceptor())
+	}
+
+	if opts.Prometheus {
+		grpc_prometheus.EnableHandlingTimeHistogram()
+		unary = append(unary, grpc_prometheus.UnaryServerInterceptor)
+		stream = append(stream, grpc_prometheus.StreamServerInterceptor)
+	}
+
+	if opts.Logging {
+		entry := log.NewEntry(log.StandardLogger())
+		unary = append(unary, grpc_logrus.UnaryServerInterceptor(entry))
+		stream = append(stream, grpc_logrus.StreamServerInterceptor(entry))
+	}
+
+	// recovery goes last so that it is the innermost interceptor, catching
+	// panics raised by the handler itself, so that the interceptors above it
+	// see the resulting codes.Internal error; panics raised by those
+	// interceptors themselves are not recovered
+	if opts.Recovery {
+		recoveryOpt := grpc_recovery.WithRecoveryHandlerContext(recoveryHandler)
+		unary = append(unary, grpc_recovery.UnaryServerInterceptor(recoveryOpt))
+		stream = append(stream, grpc_recovery.StreamServerInterceptor(recoveryOpt))
+	}
+
+	return []grpc.ServerOption{
+		grpc_middleware.WithUnaryServerChain(unary...),
+		grpc_middleware.WithStreamServerChain(stream...),
+	}
+}
+
+func recoveryHandler(ctx context.Context, p interface{}) error {
+	log.WithField("panic", p).Error("grpc: panic in handler, recovered")
+	return status.Errorf(codes.Internal, "internal server error")
+}
+
+func requireClientCertUnaryInterceptor(servicePrefix string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := verifyClientCertPresented(ctx, servicePrefix, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func requireClientCertStreamInterceptor(servicePrefix string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := verifyClientCertPresented(ss.Context(), servicePrefix, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// verifyClientCertPresented rejects the call with codes.Unauthenticated
+// unless fullMethod is outside servicePrefix, or the peer presented a TLS
+// client certificate that chained to a verified root.
+func verifyClientCertPresented(ctx context.Context, servicePrefix, fullMethod string) error {
+	if !strings.HasPrefix(fullMethod, servicePrefix) {
+		return nil
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "a verified client certificate is required")
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+		return status.Error(codes.Unauthenticated, "a verified client certificate is required")
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+// Package tls provides TLS configuration that can be rotated while the
+// process keeps running, so that certificates, keys and CAs provisioned by
+// an external issuer can be renewed without a restart.
+package tls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+
+	"github.com/brocaar/lora-app-server/internal/tls/selfsign"
+)
+
+// reloadInterval is the fallback poll interval, used in addition to
+// fsnotify to cover filesystems and editors that don't reliably emit
+// rename / write events (e.g. some bind-mounts used by secret managers).
+const reloadInterval = time.Minute
+
+// Configurator watches a certificate, key and CA file on disk and
+// atomically swaps the snapshot used to serve TLS handshakes whenever one
+// of them changes, so operators can rotate them without downtime.
+type Configurator struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	snapshot atomic.Value // *snapshot
+}
+
+type snapshot struct {
+	cert   tls.Certificate
+	caPool *x509.CertPool
+}
+
+// NewConfigurator creates a Configurator for the given cert, key and CA
+// file paths, performs an initial load and starts watching the files for
+// changes. caFile may be left blank when root / client CA verification is
+// not used. certFile / keyFile may both be left blank to track caFile only,
+// e.g. for verifying a peer without presenting a local certificate.
+func NewConfigurator(certFile, keyFile, caFile string) (*Configurator, error) {
+	c := &Configurator{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	go c.watch()
+
+	return c, nil
+}
+
+// NewAutoConfigurator behaves like NewConfigurator, except that when
+// certFile / keyFile are blank or don't exist on disk yet, it generates an
+// in-memory self-signed certificate covering hosts instead of failing to
+// start. This is intended for first-time users, tests and CI, not for
+// production use. If persist is true, the generated cert and key are
+// written to certFile / keyFile so that subsequent restarts reuse them
+// rather than generating (and trusting) a new certificate every time; a
+// missing caFile is seeded with the same generated certificate (which is
+// self-signed and thus its own CA) rather than left for NewConfigurator to
+// fail reading. An existing, operator-provisioned caFile is always left
+// untouched and used as-is.
+func NewAutoConfigurator(certFile, keyFile, caFile string, hosts []string, persist bool) (*Configurator, error) {
+	if fileExists(certFile) && fileExists(keyFile) {
+		return NewConfigurator(certFile, keyFile, caFile)
+	}
+
+	log.WithField("hosts", hosts).Warning("tls: no certificate configured, generating a self-signed certificate for development use")
+
+	cert, certPEM, keyPEM, err := selfsign.NewPEM(hosts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "generate self-signed certificate error")
+	}
+
+	if persist && certFile != "" && keyFile != "" {
+		if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+			return nil, errors.Wrap(err, "write generated certificate error")
+		}
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, errors.Wrap(err, "write generated key error")
+		}
+		if caFile != "" && !fileExists(caFile) {
+			// the generated certificate is self-signed and acts as its own
+			// CA, so it verifies mutual-TLS peers that present the same
+			// generated certificate. an existing, operator-provisioned
+			// caFile is left untouched.
+			if err := ioutil.WriteFile(caFile, certPEM, 0644); err != nil {
+				return nil, errors.Wrap(err, "write generated ca certificate error")
+			}
+		}
+		// the files now exist on disk, so watch them like any other
+		// operator-provisioned certificate and reuse them on restart
+		return NewConfigurator(certFile, keyFile, caFile)
+	}
+
+	caPool, err := autoCAPool(caFile, cert)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Configurator{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	c.snapshot.Store(&snapshot{cert: cert, caPool: caPool})
+
+	return c, nil
+}
+
+// autoCAPool returns the trust pool an in-memory (non-persisted)
+// NewAutoConfigurator snapshot should verify client certificates against:
+// the existing caFile when one is already provisioned, or the generated
+// certificate itself otherwise, so that mutual TLS between two --auto-tls
+// peers keeps working instead of silently trusting nothing.
+func autoCAPool(caFile string, cert tls.Certificate) (*x509.CertPool, error) {
+	if fileExists(caFile) {
+		raw, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read ca cert error")
+		}
+
+		caPool := x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(raw) {
+			return nil, errors.New("append ca cert to pool error")
+		}
+		return caPool, nil
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "parse generated certificate error")
+	}
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(leaf)
+	return caPool, nil
+}
+
+// fileExists reports whether path is set and refers to a file that can be
+// stat'd, i.e. a pre-existing operator-provisioned cert or key.
+func fileExists(path string) bool {
+	if path == "" {
+		return false
+	}
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func (c *Configurator) reload() error {
+	var cert tls.Certificate
+	if c.certFile != "" && c.keyFile != "" {
+		var err error
+		cert, err = tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			return errors.Wrap(err, "load keypair error")
+		}
+	}
+
+	var caPool *x509.CertPool
+	if c.caFile != "" {
+		raw, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return errors.Wrap(err, "read ca cert error")
+		}
+
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(raw) {
+			return errors.New("append ca cert to pool error")
+		}
+	}
+
+	c.snapshot.Store(&snapshot{
+		cert:   cert,
+		caPool: caPool,
+	})
+
+	log.WithFields(log.Fields{
+		"cert": c.certFile,
+		"key":  c.keyFile,
+		"ca":   c.caFile,
+	}).Info("tls: certificate snapshot (re)loaded")
+
+	return nil
+}
+
+func (c *Configurator) watch() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("tls: create file watcher error: %s", err)
+		return
+	}
+	defer watcher.Close()
+
+	for _, f := range []string{c.certFile, c.keyFile, c.caFile} {
+		if f == "" {
+			continue
+		}
+		if err := watcher.Add(f); err != nil {
+			log.Errorf("tls: watch file error: %s", err)
+		}
+	}
+
+	ticker := time.NewTicker(reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			c.reloadOrWarn()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("tls: watcher error: %s", err)
+		case <-ticker.C:
+			c.reloadOrWarn()
+		}
+	}
+}
+
+func (c *Configurator) reloadOrWarn() {
+	if err := c.reload(); err != nil {
+		log.Errorf("tls: reload certificate error, keeping previous certificate: %s", err)
+	}
+}
+
+func (c *Configurator) current() *snapshot {
+	return c.snapshot.Load().(*snapshot)
+}
+
+// GetCertificate implements the tls.Config.GetCertificate hook.
+func (c *Configurator) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := c.current().cert
+	return &cert, nil
+}
+
+// GetClientCertificate implements the tls.Config.GetClientCertificate hook.
+func (c *Configurator) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert := c.current().cert
+	return &cert, nil
+}
+
+// GetConfigForClient implements the tls.Config.GetConfigForClient hook. A
+// fresh *tls.Config is built from the current snapshot for every incoming
+// connection, so that root/client CA rotation takes effect immediately
+// without requiring the listener to be recreated.
+func (c *Configurator) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	s := c.current()
+	return &tls.Config{
+		Certificates: []tls.Certificate{s.cert},
+		ClientCAs:    s.caPool,
+	}, nil
+}
+
+// ServerTLSConfig returns a *tls.Config suitable for a TLS listener, backed
+// by this Configurator.
+func (c *Configurator) ServerTLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cfg, err := c.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			cfg.ClientAuth = clientAuth
+			return cfg, nil
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package tls
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/brocaar/lora-app-server/internal/tls/selfsign"
+)
+
+func writeTestCert(t *testing.T, dir, host string) (certFile, keyFile string) {
+	t.Helper()
+
+	_, certPEM, keyPEM, err := selfsign.NewPEM(host)
+	if err != nil {
+		t.Fatalf("generate test certificate error: %s", err)
+	}
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatalf("write test certificate error: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("write test key error: %s", err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestConfiguratorReloadPicksUpChangedCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configurator-test")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "localhost")
+
+	c := &Configurator{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		t.Fatalf("initial reload error: %s", err)
+	}
+	first := c.current().cert.Certificate[0]
+
+	_, certPEM, keyPEM, err := selfsign.NewPEM("localhost")
+	if err != nil {
+		t.Fatalf("generate second test certificate error: %s", err)
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatalf("overwrite test certificate error: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("overwrite test key error: %s", err)
+	}
+
+	if err := c.reload(); err != nil {
+		t.Fatalf("second reload error: %s", err)
+	}
+	second := c.current().cert.Certificate[0]
+
+	if bytes.Equal(first, second) {
+		t.Error("expected the snapshot to pick up the new certificate, got the same certificate bytes")
+	}
+}
+
+func TestConfiguratorBadReloadKeepsPreviousSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configurator-test")
+	if err != nil {
+		t.Fatalf("create temp dir error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "localhost")
+
+	c := &Configurator{certFile: certFile, keyFile: keyFile}
+	if err := c.reload(); err != nil {
+		t.Fatalf("initial reload error: %s", err)
+	}
+	good := c.current().cert.Certificate[0]
+
+	if err := ioutil.WriteFile(certFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("write invalid certificate error: %s", err)
+	}
+
+	if err := c.reload(); err == nil {
+		t.Fatal("expected reload with an invalid certificate to return an error")
+	}
+
+	if !bytes.Equal(good, c.current().cert.Certificate[0]) {
+		t.Error("expected the previous snapshot to be kept after a failed reload")
+	}
+}
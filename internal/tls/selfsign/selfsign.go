@@ -0,0 +1,99 @@
+// Package selfsign generates in-memory self-signed certificates for
+// zero-config development and test startup, so the server and its tests
+// don't need cert/key files provisioned on disk.
+package selfsign
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// validity is how long a generated certificate remains valid for. A year
+// keeps a generated dev/CI certificate usable across restarts without
+// operators needing to think about rotation.
+const validity = 365 * 24 * time.Hour
+
+// New generates an ECDSA P-256 keypair and a self-signed certificate
+// covering the given hosts (DNS names and / or IP addresses), valid for
+// one year from now.
+func New(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "generate key error")
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "generate serial number error")
+	}
+
+	now := time.Now()
+	tmpl := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "lora-app-server self-signed certificate",
+			Organization: []string{"lora-app-server"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, errors.Wrap(err, "create certificate error")
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        &tmpl,
+	}, nil
+}
+
+// NewPEM generates a self-signed certificate like New, and additionally
+// returns the PEM-encoded certificate and private key so that callers can
+// persist the generated pair to disk for reuse across restarts.
+func NewPEM(hosts ...string) (tls.Certificate, []byte, []byte, error) {
+	cert, err := New(hosts...)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Certificate[0],
+	})
+
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return tls.Certificate{}, nil, nil, errors.Wrap(err, "marshal private key error")
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: keyDER,
+	})
+
+	return cert, certPEM, keyPEM, nil
+}
@@ -0,0 +1,92 @@
+package selfsign
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestNewCoversRequestedHosts(t *testing.T) {
+	cert, err := New("localhost", "127.0.0.1", "example.test")
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate error: %s", err)
+	}
+
+	if len(leaf.IPAddresses) != 1 || leaf.IPAddresses[0].String() != "127.0.0.1" {
+		t.Errorf("expected 127.0.0.1 in IPAddresses, got %v", leaf.IPAddresses)
+	}
+
+	wantDNS := map[string]bool{"localhost": true, "example.test": true}
+	for _, dns := range leaf.DNSNames {
+		delete(wantDNS, dns)
+	}
+	if len(wantDNS) != 0 {
+		t.Errorf("missing expected dns names: %v", wantDNS)
+	}
+}
+
+func TestNewCertificateIsValidForAboutOneYear(t *testing.T) {
+	cert, err := New("localhost")
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate error: %s", err)
+	}
+
+	now := time.Now()
+	if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+		t.Errorf("certificate is not valid at the current time: notBefore=%s notAfter=%s now=%s", leaf.NotBefore, leaf.NotAfter, now)
+	}
+
+	if leaf.NotAfter.Sub(leaf.NotBefore) < 364*24*time.Hour {
+		t.Errorf("expected a validity period of about one year, got %s", leaf.NotAfter.Sub(leaf.NotBefore))
+	}
+}
+
+func TestNewSelfSignedCertVerifiesAgainstItself(t *testing.T) {
+	cert, err := New("localhost")
+	if err != nil {
+		t.Fatalf("New() error: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse certificate error: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, DNSName: "localhost"}); err != nil {
+		t.Errorf("expected certificate to verify against its own pool: %s", err)
+	}
+}
+
+func TestNewPEMRoundTrips(t *testing.T) {
+	cert, certPEM, keyPEM, err := NewPEM("localhost")
+	if err != nil {
+		t.Fatalf("NewPEM() error: %s", err)
+	}
+
+	if len(certPEM) == 0 || len(keyPEM) == 0 {
+		t.Fatal("expected non-empty PEM-encoded certificate and key")
+	}
+
+	roundTripped, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("parse generated PEM as a keypair error: %s", err)
+	}
+
+	if len(roundTripped.Certificate) != 1 || len(cert.Certificate) != 1 {
+		t.Fatal("expected a single-certificate chain")
+	}
+}